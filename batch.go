@@ -0,0 +1,90 @@
+package pulsar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/golang/protobuf/proto"
+	pkgerrors "github.com/pkg/errors"
+
+	pulsar_proto "github.com/t2y/go-pulsar/proto/pb"
+)
+
+// BatchEntry is one message inside a batched CommandSend payload: its
+// per-message metadata plus the raw entry payload.
+type BatchEntry struct {
+	Metadata *pulsar_proto.SingleMessageMetadata
+	Payload  string
+}
+
+// EncodeBatchPayload serializes entries into the standard Pulsar batch
+// wire format: each entry is a 4-byte big-endian SingleMessageMetadata
+// length, the marshaled SingleMessageMetadata, then the entry payload
+// bytes, all concatenated in order.
+func EncodeBatchPayload(entries []*BatchEntry) (payload string, err error) {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		entry.Metadata.PayloadSize = proto.Int32(int32(len(entry.Payload)))
+
+		metaBytes, merr := proto.Marshal(entry.Metadata)
+		if merr != nil {
+			err = pkgerrors.Wrap(merr, "failed to marshal SingleMessageMetadata")
+			return
+		}
+
+		if err = binary.Write(&buf, binary.BigEndian, uint32(len(metaBytes))); err != nil {
+			err = pkgerrors.Wrap(err, "failed to write SingleMessageMetadata length")
+			return
+		}
+		buf.Write(metaBytes)
+		buf.WriteString(entry.Payload)
+	}
+
+	payload = buf.String()
+	return
+}
+
+// DecodeBatchPayload reverses EncodeBatchPayload, splitting payload back
+// into numMessages entries. It's a no-op pass-through (single implicit
+// entry) when numMessages is 1, since unbatched sends never carry
+// per-message metadata on the wire.
+func DecodeBatchPayload(payload string, numMessages int32) (entries []*BatchEntry, err error) {
+	if numMessages <= 1 {
+		entries = []*BatchEntry{{Metadata: &pulsar_proto.SingleMessageMetadata{}, Payload: payload}}
+		return
+	}
+
+	r := bytes.NewReader([]byte(payload))
+	entries = make([]*BatchEntry, 0, numMessages)
+
+	for i := int32(0); i < numMessages; i++ {
+		var metaLen uint32
+		if err = binary.Read(r, binary.BigEndian, &metaLen); err != nil {
+			err = pkgerrors.Wrap(err, "failed to read SingleMessageMetadata length")
+			return
+		}
+
+		metaBytes := make([]byte, metaLen)
+		if _, err = io.ReadFull(r, metaBytes); err != nil {
+			err = pkgerrors.Wrap(err, "failed to read SingleMessageMetadata")
+			return
+		}
+
+		meta := &pulsar_proto.SingleMessageMetadata{}
+		if err = proto.Unmarshal(metaBytes, meta); err != nil {
+			err = pkgerrors.Wrap(err, "failed to unmarshal SingleMessageMetadata")
+			return
+		}
+
+		entryPayload := make([]byte, meta.GetPayloadSize())
+		if _, err = io.ReadFull(r, entryPayload); err != nil {
+			err = pkgerrors.Wrap(err, "failed to read batch entry payload")
+			return
+		}
+
+		entries = append(entries, &BatchEntry{Metadata: meta, Payload: string(entryPayload)})
+	}
+
+	return
+}
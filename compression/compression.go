@@ -0,0 +1,44 @@
+// Package compression implements the payload codecs used to compress
+// producer batches and decompress consumed messages, keyed by the
+// MessageMetadata.Compression field of the Pulsar wire protocol.
+package compression
+
+import (
+	"github.com/pkg/errors"
+
+	pulsar_proto "github.com/t2y/go-pulsar/proto/pb"
+)
+
+// Codec compresses and decompresses a single message (or batch) payload.
+type Codec interface {
+	// Encode compresses src and returns the compressed bytes.
+	Encode(src []byte) ([]byte, error)
+
+	// Decode decompresses src into a buffer of uncompressedSize bytes.
+	Decode(src []byte, uncompressedSize int) ([]byte, error)
+}
+
+var codecs = map[pulsar_proto.CompressionType]Codec{
+	pulsar_proto.CompressionType_NONE:   noneCodec{},
+	pulsar_proto.CompressionType_LZ4:    lz4Codec{},
+	pulsar_proto.CompressionType_ZLIB:   zlibCodec{},
+	pulsar_proto.CompressionType_ZSTD:   zstdCodec{},
+	pulsar_proto.CompressionType_SNAPPY: snappyCodec{},
+}
+
+// ByType returns the Codec registered for compression, or an error if the
+// type isn't one go-pulsar knows how to handle.
+func ByType(compression pulsar_proto.CompressionType) (codec Codec, err error) {
+	codec, ok := codecs[compression]
+	if !ok {
+		err = errors.Errorf("unsupported compression type: %v", compression)
+		return
+	}
+	return
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Encode(src []byte) ([]byte, error) { return src, nil }
+
+func (noneCodec) Decode(src []byte, uncompressedSize int) ([]byte, error) { return src, nil }
@@ -0,0 +1,35 @@
+package compression
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"github.com/pierrec/lz4"
+	"github.com/pkg/errors"
+)
+
+type lz4Codec struct{}
+
+func (lz4Codec) Encode(src []byte) (dst []byte, err error) {
+	var buf bytes.Buffer
+	w := lz4.NewWriter(&buf)
+	if _, err = w.Write(src); err != nil {
+		err = errors.Wrap(err, "failed to lz4 compress payload")
+		return
+	}
+	if err = w.Close(); err != nil {
+		err = errors.Wrap(err, "failed to close lz4 writer")
+		return
+	}
+	dst = buf.Bytes()
+	return
+}
+
+func (lz4Codec) Decode(src []byte, uncompressedSize int) (dst []byte, err error) {
+	r := lz4.NewReader(bytes.NewReader(src))
+	dst, err = ioutil.ReadAll(r)
+	if err != nil {
+		err = errors.Wrap(err, "failed to lz4 decompress payload")
+	}
+	return
+}
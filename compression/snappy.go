@@ -0,0 +1,21 @@
+package compression
+
+import (
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+)
+
+type snappyCodec struct{}
+
+func (snappyCodec) Encode(src []byte) (dst []byte, err error) {
+	dst = snappy.Encode(nil, src)
+	return
+}
+
+func (snappyCodec) Decode(src []byte, uncompressedSize int) (dst []byte, err error) {
+	dst, err = snappy.Decode(make([]byte, 0, uncompressedSize), src)
+	if err != nil {
+		err = errors.Wrap(err, "failed to snappy decompress payload")
+	}
+	return
+}
@@ -0,0 +1,41 @@
+package compression
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+type zlibCodec struct{}
+
+func (zlibCodec) Encode(src []byte) (dst []byte, err error) {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err = w.Write(src); err != nil {
+		err = errors.Wrap(err, "failed to zlib compress payload")
+		return
+	}
+	if err = w.Close(); err != nil {
+		err = errors.Wrap(err, "failed to close zlib writer")
+		return
+	}
+	dst = buf.Bytes()
+	return
+}
+
+func (zlibCodec) Decode(src []byte, uncompressedSize int) (dst []byte, err error) {
+	r, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		err = errors.Wrap(err, "failed to open zlib reader")
+		return
+	}
+	defer r.Close()
+
+	dst, err = ioutil.ReadAll(r)
+	if err != nil {
+		err = errors.Wrap(err, "failed to zlib decompress payload")
+	}
+	return
+}
@@ -0,0 +1,35 @@
+package compression
+
+import (
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+type zstdCodec struct{}
+
+func (zstdCodec) Encode(src []byte) (dst []byte, err error) {
+	w, err := zstd.NewWriter(nil)
+	if err != nil {
+		err = errors.Wrap(err, "failed to open zstd writer")
+		return
+	}
+	defer w.Close()
+
+	dst = w.EncodeAll(src, make([]byte, 0, len(src)))
+	return
+}
+
+func (zstdCodec) Decode(src []byte, uncompressedSize int) (dst []byte, err error) {
+	r, err := zstd.NewReader(nil)
+	if err != nil {
+		err = errors.Wrap(err, "failed to open zstd reader")
+		return
+	}
+	defer r.Close()
+
+	dst, err = r.DecodeAll(src, make([]byte, 0, uncompressedSize))
+	if err != nil {
+		err = errors.Wrap(err, "failed to zstd decompress payload")
+	}
+	return
+}
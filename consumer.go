@@ -1,20 +1,100 @@
 package pulsar
 
 import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
 
+	"github.com/t2y/go-pulsar/compression"
 	"github.com/t2y/go-pulsar/proto/command"
 	pulsar_proto "github.com/t2y/go-pulsar/proto/pb"
 )
 
+// defaultReceiverQueueSize mirrors the reference clients' default prefetch
+// window.
+const defaultReceiverQueueSize = 1000
+
+// ConsumerMessage pairs a delivered Message with any error encountered
+// reading it off the connection, so a single channel can carry both.
+type ConsumerMessage struct {
+	Message *command.Message
+	Err     error
+}
+
+// ConsumerOption configures optional Consumer behavior at construction
+// time, e.g. WithReceiverQueueSize.
+type ConsumerOption func(*Consumer)
+
+// WithReceiverQueueSize overrides how many messages the consumer
+// prefetches (and buffers locally) ahead of the application.
+func WithReceiverQueueSize(size int) ConsumerOption {
+	return func(c *Consumer) {
+		c.ReceiverQueueSize = size
+	}
+}
+
+// WithInitialPosition sets where a new subscription starts reading from
+// (Latest or Earliest). It has no effect on an existing subscription.
+func WithInitialPosition(position pulsar_proto.CommandSubscribe_InitialPosition) ConsumerOption {
+	return func(c *Consumer) {
+		c.InitialPosition = position
+	}
+}
+
+// subTypeFromString maps the subType argument accepted by Subscribe onto
+// the wire enum, so callers keep passing a plain string while still
+// getting Exclusive/Failover/Key_Shared semantics instead of an
+// always-Shared subscription.
+func subTypeFromString(subType string) (*pulsar_proto.CommandSubscribe_SubType, error) {
+	switch subType {
+	case "Exclusive":
+		return pulsar_proto.CommandSubscribe_Exclusive.Enum(), nil
+	case "Shared":
+		return pulsar_proto.CommandSubscribe_Shared.Enum(), nil
+	case "Failover":
+		return pulsar_proto.CommandSubscribe_Failover.Enum(), nil
+	case "KeyShared":
+		return pulsar_proto.CommandSubscribe_Key_Shared.Enum(), nil
+	default:
+		return nil, errors.Errorf("unknown subscription type: %s", subType)
+	}
+}
+
 type Consumer struct {
 	client *Client
+
+	ConsumerID        uint64
+	ReceiverQueueSize int
+	InitialPosition   pulsar_proto.CommandSubscribe_InitialPosition
+	Topic             string
+	Subscription      string
+
+	// queued holds entries already split out of a batched CommandMessage
+	// frame that the delivery loop hasn't pushed out individually yet.
+	queued []*command.Message
+
+	rawChan chan ConsumerMessage
+	outChan chan ConsumerMessage
+	drained int32 // messages delivered since the last flow top-up
+
+	// successCh is where readLoop hands off a CommandSuccess reply to a
+	// Seek/SeekByTime, since it owns the connection's receive side once
+	// Subscribe has started it.
+	successCh chan *pulsar_proto.CommandSuccess
+	seekMu    sync.Mutex
+
+	readerOnce sync.Once
+	closeOnce  sync.Once
+	stopCh     chan struct{}
 }
 
 func (c *Consumer) Subscribe(
-	topic, subscription, subType string, consumerId, requestId uint64,
+	topic, subscription, subType string, requestId uint64,
 ) (err error) {
 	err = c.client.LookupTopic(topic, requestId, false)
 	if err != nil {
@@ -22,12 +102,22 @@ func (c *Consumer) Subscribe(
 		return
 	}
 
+	c.Topic = topic
+	c.Subscription = subscription
+
+	subTypeEnum, err := subTypeFromString(subType)
+	if err != nil {
+		err = errors.Wrap(err, "failed to parse subscription type")
+		return
+	}
+
 	sub := &pulsar_proto.CommandSubscribe{
-		Topic:        proto.String(topic),
-		Subscription: proto.String(subscription),
-		SubType:      pulsar_proto.CommandSubscribe_Shared.Enum(),
-		ConsumerId:   proto.Uint64(consumerId),
-		RequestId:    proto.Uint64(requestId),
+		Topic:           proto.String(topic),
+		Subscription:    proto.String(subscription),
+		SubType:         subTypeEnum,
+		ConsumerId:      proto.Uint64(c.ConsumerID),
+		RequestId:       proto.Uint64(requestId),
+		InitialPosition: c.InitialPosition.Enum(),
 	}
 
 	err = c.client.Send(&Request{Message: sub})
@@ -37,6 +127,17 @@ func (c *Consumer) Subscribe(
 	}
 
 	log.Debug("sent subscribe")
+
+	if err = c.Flow(c.ConsumerID, uint32(c.ReceiverQueueSize)); err != nil {
+		err = errors.Wrap(err, "failed to send initial flow")
+		return
+	}
+
+	c.readerOnce.Do(func() {
+		go c.readLoop()
+		go c.deliverLoop()
+	})
+
 	return
 }
 
@@ -58,35 +159,302 @@ func (c *Consumer) Flow(
 	return
 }
 
+// Seek resets this subscription to replay from msgID, blocking until the
+// broker confirms the rewind. seekMu serializes concurrent Seek/SeekByTime
+// calls, since they share the single-slot successCh readLoop hands the
+// reply to.
+func (c *Consumer) Seek(requestId uint64, msgID *pulsar_proto.MessageIdData) (err error) {
+	c.seekMu.Lock()
+	defer c.seekMu.Unlock()
+
+	seek := &pulsar_proto.CommandSeek{
+		ConsumerId: proto.Uint64(c.ConsumerID),
+		RequestId:  proto.Uint64(requestId),
+		MessageId:  msgID,
+	}
+
+	if err = c.client.Send(&Request{Message: seek}); err != nil {
+		err = errors.Wrap(err, "failed to send seek command")
+		return
+	}
+	log.Debug("sent seek")
+
+	return c.receiveSuccess()
+}
+
+// SeekByTime resets this subscription to replay from the first message
+// published at or after publishTime, blocking until the broker confirms
+// the rewind.
+func (c *Consumer) SeekByTime(requestId uint64, publishTime time.Time) (err error) {
+	c.seekMu.Lock()
+	defer c.seekMu.Unlock()
+
+	millis := uint64(publishTime.UnixNano() / int64(time.Millisecond))
+	seek := &pulsar_proto.CommandSeek{
+		ConsumerId:         proto.Uint64(c.ConsumerID),
+		RequestId:          proto.Uint64(requestId),
+		MessagePublishTime: proto.Uint64(millis),
+	}
+
+	if err = c.client.Send(&Request{Message: seek}); err != nil {
+		err = errors.Wrap(err, "failed to send seek command")
+		return
+	}
+	log.Debug("sent seek")
+
+	return c.receiveSuccess()
+}
+
+// receiveSuccess waits for the CommandSuccess reply to a Seek/SeekByTime.
+// It reads from successCh instead of the connection directly: readLoop
+// owns the connection's receive side once Subscribe has started it, so a
+// second reader here would race readLoop for the same frame and just as
+// often steal the next data Message instead of the success reply.
+func (c *Consumer) receiveSuccess() (err error) {
+	select {
+	case success := <-c.successCh:
+		log.WithFields(log.Fields{
+			"success": success,
+		}).Debug("received success")
+	case <-c.stopCh:
+		err = errors.New("consumer closed while waiting for success command")
+	}
+
+	return
+}
+
+// Chan returns the channel messages are delivered on. Reading from it
+// directly still participates in automatic flow-control top-ups, same as
+// Receive/ReceiveAsync.
+func (c *Consumer) Chan() <-chan ConsumerMessage {
+	return c.outChan
+}
+
+// Receive blocks until the next message is delivered or ctx is done.
+func (c *Consumer) Receive(ctx context.Context) (msg *command.Message, err error) {
+	select {
+	case cm := <-c.outChan:
+		return cm.Message, cm.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ReceiveAsync forwards delivered messages onto out until ctx is done.
+func (c *Consumer) ReceiveAsync(ctx context.Context, out chan ConsumerMessage) {
+	for {
+		select {
+		case cm := <-c.outChan:
+			select {
+			case out <- cm:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ReceiveMessage is a convenience wrapper around Receive for callers that
+// don't need cancellation.
 func (c *Consumer) ReceiveMessage() (msg *command.Message, err error) {
+	return c.Receive(context.Background())
+}
+
+// readLoop owns the connection's receive side: it pulls frames, splits
+// batches, and feeds individual messages into rawChan for deliverLoop to
+// hand out. A read error is treated as terminal (the connection is gone),
+// and stopCh lets CloseConsumer unwind the loop too. stopCh is checked
+// between frames only: a client.Receive already blocked in receiveNext is
+// not interrupted, so the loop exits once that read returns. It always
+// closes rawChan on exit so
+// deliverLoop isn't left ranging over a channel nobody will feed again.
+func (c *Consumer) readLoop() {
+	defer close(c.rawChan)
+
+	for {
+		select {
+		case <-c.stopCh:
+			return
+		default:
+		}
+
+		if len(c.queued) == 0 {
+			msgs, err := c.receiveNext()
+			if err != nil {
+				select {
+				case c.rawChan <- ConsumerMessage{Err: err}:
+				case <-c.stopCh:
+				}
+				return
+			}
+			if msgs == nil {
+				// a CommandSuccess (Seek/SeekByTime reply) was handed off
+				// to successCh instead of being a deliverable message.
+				continue
+			}
+			c.queued = msgs
+		}
+
+		msg := c.queued[0]
+		c.queued = c.queued[1:]
+
+		select {
+		case c.rawChan <- ConsumerMessage{Message: msg}:
+		case <-c.stopCh:
+			return
+		}
+	}
+}
+
+// deliverLoop forwards rawChan onto the public outChan, accounting for
+// how many messages have been handed to the application regardless of
+// whether it reads via Chan, Receive, or ReceiveAsync, and tops up the
+// broker's flow permits once half the receiver queue has drained. It
+// exits once readLoop closes rawChan (connection gone or CloseConsumer
+// called), closing outChan in turn so blocked readers unblock instead of
+// hanging forever.
+func (c *Consumer) deliverLoop() {
+	defer close(c.outChan)
+
+	for cm := range c.rawChan {
+		select {
+		case c.outChan <- cm:
+		case <-c.stopCh:
+			return
+		}
+		if cm.Err != nil {
+			return
+		}
+
+		if drained := atomic.AddInt32(&c.drained, 1); drained >= int32(c.ReceiverQueueSize/2) {
+			atomic.AddInt32(&c.drained, -drained)
+			if err := c.Flow(c.ConsumerID, uint32(drained)); err != nil {
+				log.Error("failed to send flow top-up", err)
+			}
+		}
+	}
+}
+
+// receiveNext reads one frame off the connection and dispatches it by
+// type, since readLoop is the only reader left on the connection once
+// Subscribe has started it and must demux everything that arrives here,
+// including the CommandSuccess replies Seek/SeekByTime are waiting on.
+// A CommandSuccess is handed off to successCh and receiveNext returns
+// (nil, nil) so the caller reads the next frame instead of treating it
+// as a deliverable message. Otherwise the frame is decompressed and
+// split into its individual batch entries (a single entry for an
+// unbatched send); each returned Message carries its BatchIndex so the
+// caller can ack it individually via SendAck.
+func (c *Consumer) receiveNext() (msgs []*command.Message, err error) {
 	res, err := c.client.Receive()
 	if err != nil {
 		err = errors.Wrap(err, "failed to receive message command")
 		return
 	}
 
-	cmd := res.BaseCommand.GetRawCommand().GetMessage()
-	msg = command.NewMessage(cmd, res.Payload)
+	base := res.BaseCommand
+	switch t := base.GetType(); {
+	case t != nil && *t == pulsar_proto.BaseCommand_SUCCESS:
+		success := base.GetRawCommand().GetSuccess()
+		select {
+		case c.successCh <- success:
+		case <-c.stopCh:
+		}
+		return
+	case t != nil && *t == pulsar_proto.BaseCommand_MESSAGE:
+	default:
+		err = errors.Errorf("unknown command type: %v", t)
+		return
+	}
+
+	cmd := base.GetRawCommand().GetMessage()
+
+	payload, err := decompressPayload(res.Meta, res.Payload)
+	if err != nil {
+		err = errors.Wrap(err, "failed to decompress message payload")
+		return
+	}
+
+	numMessages := int32(1)
+	if res.Meta != nil {
+		numMessages = res.Meta.GetNumMessagesInBatch()
+		if numMessages == 0 {
+			numMessages = 1
+		}
+	}
+
+	entries, err := DecodeBatchPayload(payload, numMessages)
+	if err != nil {
+		err = errors.Wrap(err, "failed to unbatch message payload")
+		return
+	}
+
+	msgs = make([]*command.Message, 0, len(entries))
+	for i, entry := range entries {
+		msg := command.NewMessage(cmd, entry.Payload)
+		if msg.MessageId != nil && numMessages > 1 {
+			// cmd is shared across every entry in the batch, so NewMessage
+			// hands back messages that alias the same MessageIdData. Clone
+			// it before stamping BatchIndex or every entry ends up with
+			// the same (last-written) index and none can be acked
+			// individually.
+			msg.MessageId = proto.Clone(msg.MessageId).(*pulsar_proto.MessageIdData)
+			msg.MessageId.BatchIndex = proto.Int32(int32(i))
+		}
+		msgs = append(msgs, msg)
+	}
 
 	log.WithFields(log.Fields{
-		"message": cmd,
-		"payload": res.Payload,
+		"message":     cmd,
+		"numMessages": numMessages,
 	}).Debug("receive message")
 	return
 }
 
+// decompressPayload transparently reverses whatever codec the producer
+// recorded on meta.Compression, returning payload unchanged when the
+// message wasn't compressed (or meta is unavailable).
+func decompressPayload(meta *pulsar_proto.MessageMetadata, payload string) (string, error) {
+	if meta == nil || meta.GetCompression() == pulsar_proto.CompressionType_NONE {
+		return payload, nil
+	}
+
+	codec, err := compression.ByType(meta.GetCompression())
+	if err != nil {
+		return "", errors.Wrap(err, "failed to resolve compression codec")
+	}
+
+	decoded, err := codec.Decode([]byte(payload), int(meta.GetUncompressedSize()))
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
 func (c *Consumer) SendAck(
-	consumerId uint64, ackType pulsar_proto.CommandAck_AckType,
+	ackType pulsar_proto.CommandAck_AckType,
 	msgIdData *pulsar_proto.MessageIdData,
 	validationError *pulsar_proto.CommandAck_ValidationError,
+	txn *Transaction,
 ) (err error) {
 	ack := &pulsar_proto.CommandAck{
-		ConsumerId:      proto.Uint64(consumerId),
+		ConsumerId:      proto.Uint64(c.ConsumerID),
 		AckType:         ackType.Enum(),
 		MessageId:       msgIdData,
 		ValidationError: validationError,
 	}
 
+	if txn != nil {
+		if err = txn.addSubscription(c); err != nil {
+			err = errors.Wrap(err, "failed to register subscription with transaction")
+			return
+		}
+		ack.TxnidMostBits = proto.Uint64(txn.id.MostBits)
+		ack.TxnidLeastBits = proto.Uint64(txn.id.LeastBits)
+	}
+
 	err = c.client.Send(&Request{Message: ack})
 	if err != nil {
 		err = errors.Wrap(err, "failed to send ack command")
@@ -98,10 +466,12 @@ func (c *Consumer) SendAck(
 }
 
 func (c *Consumer) CloseConsumer(
-	consumerId, requestId uint64,
+	requestId uint64,
 ) (err error) {
+	c.closeOnce.Do(func() { close(c.stopCh) })
+
 	close := &pulsar_proto.CommandCloseConsumer{
-		ConsumerId: proto.Uint64(consumerId),
+		ConsumerId: proto.Uint64(c.ConsumerID),
 		RequestId:  proto.Uint64(requestId),
 	}
 
@@ -115,10 +485,25 @@ func (c *Consumer) CloseConsumer(
 	return
 }
 
-func NewConsumer(client *Client) (c *Consumer) {
+func NewConsumer(client *Client, consumerID uint64, opts ...ConsumerOption) (c *Consumer) {
 	client.Connect() // nolint: errcheck
+
 	c = &Consumer{
-		client: client,
+		client:            client,
+		ConsumerID:        consumerID,
+		ReceiverQueueSize: defaultReceiverQueueSize,
+	}
+
+	for _, opt := range opts {
+		opt(c)
 	}
+
+	c.rawChan = make(chan ConsumerMessage, c.ReceiverQueueSize)
+	// unbuffered, so deliverLoop only counts a message as drained once a
+	// reader has actually taken it; prefetched messages wait in rawChan.
+	c.outChan = make(chan ConsumerMessage)
+	c.successCh = make(chan *pulsar_proto.CommandSuccess, 1)
+	c.stopCh = make(chan struct{})
+
 	return
-}
\ No newline at end of file
+}
@@ -1,6 +1,7 @@
 package pulsar
 
 import (
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -8,16 +9,96 @@ import (
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/t2y/go-pulsar/compression"
 	"github.com/t2y/go-pulsar/proto/command"
 	pulsar_proto "github.com/t2y/go-pulsar/proto/pb"
 )
 
+// defaults for the async batching producer. These mirror the reference
+// client's conservative out-of-the-box behavior: small batches, a short
+// linger window, and a bounded amount of in-flight work.
+const (
+	defaultBatchingMaxPublishDelay = 10 * time.Millisecond
+	defaultBatchingMaxMessages     = 1000
+	defaultBatchingMaxBytes        = 128 * 1024
+	defaultMaxPendingMessages      = 1000
+)
+
+// SendCallback is invoked once a previously queued message has been
+// acknowledged (or has failed) by the broker.
+type SendCallback func(msgID *pulsar_proto.MessageIdData, err error)
+
+// pendingSend tracks a single SequenceId awaiting a CommandSendReceipt (or
+// CommandSendError) from the broker.
+type pendingSend struct {
+	sequenceID uint64
+	callback   SendCallback
+}
+
+// batchedMessage is one payload queued into the current batch, alongside
+// the callback that must fire once the batch it ends up in is receipted.
+type batchedMessage struct {
+	payload    string
+	keyValues  KeyValues
+	callback   SendCallback
+}
+
 type Producer struct {
 	*PulsarClient
 	SequenceID uint64
-	Name string
-	Topic string
-	ID uint64
+	Name       string
+	Topic      string
+	ID         uint64
+
+	Compression pulsar_proto.CompressionType
+
+	BatchingMaxPublishDelay time.Duration
+	BatchingMaxMessages     int
+	BatchingMaxBytes        int
+	MaxPendingMessages      int
+
+	inflight chan struct{}
+
+	batchMu      sync.Mutex
+	batch        []*batchedMessage
+	batchBytes   int
+	batchTimer   *time.Timer
+
+	pendingMu sync.Mutex
+	pending   []*pendingSend
+
+	receiptsOnce sync.Once
+}
+
+// ProducerOption configures optional Producer behavior at construction
+// time, e.g. WithCompression or WithBatching.
+type ProducerOption func(*Producer)
+
+// WithCompression sets the codec used to compress message payloads before
+// they're framed onto the wire. The zero value (CompressionType_NONE)
+// disables compression.
+func WithCompression(compression pulsar_proto.CompressionType) ProducerOption {
+	return func(p *Producer) {
+		p.Compression = compression
+	}
+}
+
+// WithBatching overrides the default batching linger window and
+// max-count/max-bytes thresholds used by SendAsync.
+func WithBatching(maxPublishDelay time.Duration, maxMessages, maxBytes int) ProducerOption {
+	return func(p *Producer) {
+		p.BatchingMaxPublishDelay = maxPublishDelay
+		p.BatchingMaxMessages = maxMessages
+		p.BatchingMaxBytes = maxBytes
+	}
+}
+
+// WithMaxPendingMessages bounds how many messages may be in flight
+// (queued or sent but not yet receipted) before SendAsync blocks.
+func WithMaxPendingMessages(max int) ProducerOption {
+	return func(p *Producer) {
+		p.MaxPendingMessages = max
+	}
 }
 
 func (p *Producer) Open(requestID uint64) error {
@@ -41,6 +122,15 @@ func (p *Producer) Open(requestID uint64) error {
 	return nil
 }
 
+// ensureReceiptLoop starts receiptLoop the first time the async API is
+// used. It must stay off for plain SendSend/SendBatchSend users: they
+// read CommandSendReceipt/CommandSendError themselves via
+// ReceiveSendReceipt, and a background reader would race them for the
+// same connection.
+func (p *Producer) ensureReceiptLoop() {
+	p.receiptsOnce.Do(func() { go p.receiptLoop() })
+}
+
 func (p *Producer) CreateProducer(
 	requestId uint64,
 ) (err error) {
@@ -90,9 +180,35 @@ func (p *Producer) ReceiveProducerSuccess() (
 
 const defaultNumMessages = 1
 
+// compressPayload runs payload through the codec registered for
+// p.Compression, returning the bytes to put on the wire along with the
+// original (uncompressed) size to record on MessageMetadata.
+func (p *Producer) compressPayload(payload string) (compressed string, uncompressedSize int32, err error) {
+	uncompressedSize = int32(len(payload))
+	if p.Compression == pulsar_proto.CompressionType_NONE {
+		compressed = payload
+		return
+	}
+
+	codec, err := compression.ByType(p.Compression)
+	if err != nil {
+		err = errors.Wrap(err, "failed to resolve compression codec")
+		return
+	}
+
+	out, err := codec.Encode([]byte(payload))
+	if err != nil {
+		err = errors.Wrap(err, "failed to compress payload")
+		return
+	}
+	compressed = string(out)
+	return
+}
+
 func (p *Producer) SendSend(
 	payload string,
 	keyValues KeyValues,
+	txn *Transaction,
 ) (err error) {
 	sequenceID := atomic.AddUint64(&p.SequenceID, 1) - 1
 	send := &pulsar_proto.CommandSend{
@@ -101,15 +217,31 @@ func (p *Producer) SendSend(
 		NumMessages: proto.Int32(defaultNumMessages),
 	}
 
+	if txn != nil {
+		if err = txn.addPartition(p); err != nil {
+			err = errors.Wrap(err, "failed to register producer topic with transaction")
+			return
+		}
+		send.TxnidMostBits = proto.Uint64(txn.id.MostBits)
+		send.TxnidLeastBits = proto.Uint64(txn.id.LeastBits)
+	}
+
+	compressed, uncompressedSize, err := p.compressPayload(payload)
+	if err != nil {
+		return
+	}
+
 	now := time.Now().Unix()
 	meta := &pulsar_proto.MessageMetadata{
-		ProducerName: proto.String(p.Name),
-		SequenceId:   proto.Uint64(sequenceID),
-		PublishTime:  proto.Uint64(uint64(now)),
-		Properties:   keyValues.Convert(),
+		ProducerName:     proto.String(p.Name),
+		SequenceId:       proto.Uint64(sequenceID),
+		PublishTime:      proto.Uint64(uint64(now)),
+		Properties:       keyValues.Convert(),
+		Compression:      p.Compression.Enum(),
+		UncompressedSize: proto.Uint32(uint32(uncompressedSize)),
 	}
 
-	request := &Request{Message: send, Meta: meta, Payload: payload}
+	request := &Request{Message: send, Meta: meta, Payload: compressed}
 	if err = p.conn.Send(request); err != nil {
 		err = errors.Wrap(err, "failed to send 'send' command")
 		return
@@ -119,9 +251,24 @@ func (p *Producer) SendSend(
 	return
 }
 
+// SendBatchSend is deprecated: it still frames batchMessage through the
+// legacy Request.BatchMessage path instead of the 4-byte-length
+// SingleMessageMetadata wire format EncodeBatchPayload/DecodeBatchPayload
+// implement, so batches sent here won't round-trip through a consumer's
+// NumMessagesInBatch > 1 unbatching. Prefer SendAsync, which batches,
+// frames, and compresses messages using that format end to end.
+//
+// Scope note: compressing a batch means recompressing the serialized
+// bytes EncodeBatchPayload produces, but batchMessage here is the opaque
+// legacy command.BatchMessage, not that serialized form, and this
+// package has no encoder for it. Rather than guess at its wire layout,
+// SendBatchSend rejects a non-NONE compressionType instead of silently
+// advertising a codec it never applies; compression on this path is out
+// of scope until SendBatchSend itself is migrated to EncodeBatchPayload.
 func (p *Producer) SendBatchSend(
 	batchMessage command.BatchMessage,
-	compression *pulsar_proto.CompressionType,
+	compressionType *pulsar_proto.CompressionType,
+	txn *Transaction,
 ) (err error) {
 	sequenceID := atomic.AddUint64(&p.SequenceID, 1) - 1
 	numMessages := int32(len(batchMessage))
@@ -131,14 +278,31 @@ func (p *Producer) SendBatchSend(
 		NumMessages: proto.Int32(numMessages),
 	}
 
+	if txn != nil {
+		if err = txn.addPartition(p); err != nil {
+			err = errors.Wrap(err, "failed to register producer topic with transaction")
+			return
+		}
+		send.TxnidMostBits = proto.Uint64(txn.id.MostBits)
+		send.TxnidLeastBits = proto.Uint64(txn.id.LeastBits)
+	}
+
+	if compressionType != nil && *compressionType != pulsar_proto.CompressionType_NONE {
+		err = errors.Errorf(
+			"compression %v requested but SendBatchSend does not compress batchMessage; use SendAsync instead",
+			*compressionType,
+		)
+		return
+	}
+
 	now := time.Now().Unix()
 	meta := &pulsar_proto.MessageMetadata{
 		ProducerName: proto.String(p.Name),
 		SequenceId:   proto.Uint64(sequenceID),
 		PublishTime:  proto.Uint64(uint64(now)),
 		Properties:   []*pulsar_proto.KeyValue{},
-		// batch mode
-		Compression:        compression,
+		// batch mode; Compression intentionally left unset, see the
+		// deprecation note on SendBatchSend.
 		NumMessagesInBatch: proto.Int32(numMessages),
 	}
 
@@ -152,6 +316,264 @@ func (p *Producer) SendBatchSend(
 	return
 }
 
+// SendAsync queues payload for delivery without blocking on a broker
+// round-trip. It's coalesced with other pending sends into a single
+// CommandSend, either once BatchingMaxPublishDelay elapses or once
+// BatchingMaxMessages/BatchingMaxBytes is reached. callback fires once the
+// batch containing this message is receipted (or fails).
+//
+// SendAsync blocks when MaxPendingMessages sends are already queued or
+// in flight, applying back-pressure instead of growing the queue
+// unbounded.
+func (p *Producer) SendAsync(
+	payload string,
+	keyValues KeyValues,
+	callback SendCallback,
+) (err error) {
+	p.ensureReceiptLoop()
+
+	p.inflight <- struct{}{}
+
+	p.batchMu.Lock()
+	p.batch = append(p.batch, &batchedMessage{payload: payload, keyValues: keyValues, callback: callback})
+	p.batchBytes += len(payload)
+
+	flush := len(p.batch) >= p.batchingMaxMessages() || p.batchBytes >= p.batchingMaxBytes()
+	if p.batchTimer == nil {
+		p.batchTimer = time.AfterFunc(p.batchingMaxPublishDelay(), func() { p.flushBatch() })
+	}
+	p.batchMu.Unlock()
+
+	if flush {
+		p.flushBatch()
+	}
+
+	log.Debug("queued async send")
+	return
+}
+
+func (p *Producer) batchingMaxPublishDelay() time.Duration {
+	if p.BatchingMaxPublishDelay > 0 {
+		return p.BatchingMaxPublishDelay
+	}
+	return defaultBatchingMaxPublishDelay
+}
+
+func (p *Producer) batchingMaxMessages() int {
+	if p.BatchingMaxMessages > 0 {
+		return p.BatchingMaxMessages
+	}
+	return defaultBatchingMaxMessages
+}
+
+func (p *Producer) batchingMaxBytes() int {
+	if p.BatchingMaxBytes > 0 {
+		return p.BatchingMaxBytes
+	}
+	return defaultBatchingMaxBytes
+}
+
+// flushBatch drains whatever is currently buffered into a single
+// CommandSend and registers the batch's callbacks against its
+// SequenceId so the receipt loop can dispatch them in order.
+func (p *Producer) flushBatch() (err error) {
+	p.batchMu.Lock()
+	if p.batchTimer != nil {
+		p.batchTimer.Stop()
+		p.batchTimer = nil
+	}
+	pending := p.batch
+	p.batch = nil
+	p.batchBytes = 0
+	p.batchMu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	sequenceID := atomic.AddUint64(&p.SequenceID, 1) - 1
+	numMessages := int32(len(pending))
+	send := &pulsar_proto.CommandSend{
+		ProducerId:  proto.Uint64(p.ID),
+		SequenceId:  proto.Uint64(sequenceID),
+		NumMessages: proto.Int32(numMessages),
+	}
+
+	// Register before any of the framing/compression below can fail: once
+	// a batchedMessage is on pending it already holds an inflight token,
+	// and registerPending's callback is the only thing that releases it.
+	// An early return past this point without registering would leak
+	// those tokens and wedge a later Flush forever.
+	p.registerPending(sequenceID, numMessages, pending)
+
+	entries := make([]*BatchEntry, 0, len(pending))
+	for _, bm := range pending {
+		entries = append(entries, &BatchEntry{
+			Metadata: &pulsar_proto.SingleMessageMetadata{
+				Properties: bm.keyValues.Convert(),
+			},
+			Payload: bm.payload,
+		})
+	}
+
+	batchPayload, err := EncodeBatchPayload(entries)
+	if err != nil {
+		err = errors.Wrap(err, "failed to frame batch payload")
+		p.failPending(sequenceID, err)
+		return
+	}
+
+	compressed, uncompressedSize, err := p.compressPayload(batchPayload)
+	if err != nil {
+		p.failPending(sequenceID, err)
+		return
+	}
+
+	now := time.Now().Unix()
+	meta := &pulsar_proto.MessageMetadata{
+		ProducerName:       proto.String(p.Name),
+		SequenceId:         proto.Uint64(sequenceID),
+		PublishTime:        proto.Uint64(uint64(now)),
+		Compression:        p.Compression.Enum(),
+		UncompressedSize:   proto.Uint32(uint32(uncompressedSize)),
+		NumMessagesInBatch: proto.Int32(numMessages),
+	}
+
+	request := &Request{Message: send, Meta: meta, Payload: compressed}
+	if err = p.conn.Send(request); err != nil {
+		err = errors.Wrap(err, "failed to send async batch 'send' command")
+		p.failPending(sequenceID, err)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"sequenceId":  sequenceID,
+		"numMessages": numMessages,
+	}).Debug("sent async batch 'send'")
+	return
+}
+
+func (p *Producer) registerPending(sequenceID uint64, count int32, batch []*batchedMessage) {
+	callback := func(msgID *pulsar_proto.MessageIdData, err error) {
+		for _, bm := range batch {
+			if bm.callback != nil {
+				bm.callback(msgID, err)
+			}
+		}
+		for i := int32(0); i < count; i++ {
+			<-p.inflight
+		}
+	}
+
+	p.pendingMu.Lock()
+	p.pending = append(p.pending, &pendingSend{sequenceID: sequenceID, callback: callback})
+	p.pendingMu.Unlock()
+}
+
+func (p *Producer) failPending(sequenceID uint64, err error) {
+	p.dispatchReceipt(sequenceID, nil, err)
+}
+
+// failAllPending resolves every still-pending send with err. It's used
+// when the connection itself is gone and no further receipts will ever
+// arrive, so callbacks (and the inflight tokens they release) don't hang
+// forever waiting on a dead receiptLoop.
+func (p *Producer) failAllPending(err error) {
+	p.pendingMu.Lock()
+	pending := p.pending
+	p.pending = nil
+	p.pendingMu.Unlock()
+
+	for _, ps := range pending {
+		ps.callback(nil, err)
+	}
+}
+
+// dispatchReceipt resolves the pending send matching sequenceID together
+// with every send still pending ahead of it (and, on failure, every
+// pending send queued after it, since the broker guarantees ordered
+// delivery within a producer) in FIFO order. All of them get the same
+// msgID and err.
+func (p *Producer) dispatchReceipt(sequenceID uint64, msgID *pulsar_proto.MessageIdData, err error) {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+
+	for i, ps := range p.pending {
+		if ps.sequenceID != sequenceID {
+			continue
+		}
+
+		resolved := p.pending[:i+1]
+		p.pending = p.pending[i+1:]
+
+		if err != nil {
+			// a CommandSendError fails this send and cancels everything
+			// still pending behind it.
+			resolved = append(resolved, p.pending...)
+			p.pending = nil
+		}
+
+		for _, r := range resolved {
+			r.callback(msgID, err)
+		}
+		return
+	}
+}
+
+// receiptLoop consumes CommandSendReceipt/CommandSendError frames off the
+// connection and resolves queued SendAsync callbacks in order. It runs
+// for the lifetime of the producer.
+func (p *Producer) receiptLoop() {
+	for {
+		res, err := p.conn.Receive()
+		if err != nil {
+			log.Error("failed to receive in receipt loop", err)
+			p.failAllPending(errors.Wrap(err, "receipt loop connection lost"))
+			return
+		}
+
+		base := res.BaseCommand
+		switch t := base.GetType(); *t {
+		case pulsar_proto.BaseCommand_SEND_RECEIPT:
+			receipt := base.GetRawCommand().GetSendReceipt()
+			p.dispatchReceipt(receipt.GetSequenceId(), receipt.GetMessageId(), nil)
+		case pulsar_proto.BaseCommand_SEND_ERROR:
+			sendErr := base.GetRawCommand().GetSendError()
+			p.dispatchReceipt(sendErr.GetSequenceId(), nil, errors.Errorf("%v: %s", sendErr.GetError(), sendErr.GetMessage()))
+		default:
+			// not a receipt frame; it has already been read off the
+			// connection and is dropped.
+			continue
+		}
+	}
+}
+
+// Flush blocks until every message queued via SendAsync (including a
+// partially-filled batch still waiting out its linger window) has been
+// sent and receipted by the broker.
+func (p *Producer) Flush() (err error) {
+	if err = p.flushBatch(); err != nil {
+		return
+	}
+
+	for i := 0; i < p.maxPendingMessages(); i++ {
+		p.inflight <- struct{}{}
+	}
+	for i := 0; i < p.maxPendingMessages(); i++ {
+		<-p.inflight
+	}
+
+	log.Debug("flushed producer")
+	return
+}
+
+func (p *Producer) maxPendingMessages() int {
+	if p.MaxPendingMessages > 0 {
+		return p.MaxPendingMessages
+	}
+	return defaultMaxPendingMessages
+}
+
 func (p *Producer) ReceiveSendReceipt() (
 	receipt *pulsar_proto.CommandSendReceipt, err error,
 ) {
@@ -185,12 +607,22 @@ func (p *Producer) CloseProducer(
 	return
 }
 
-func NewProducer(client *PulsarClient, producerID uint64, topic string) (p *Producer) {
+func NewProducer(client *PulsarClient, producerID uint64, topic string, opts ...ProducerOption) (p *Producer) {
 	p = &Producer{
 		PulsarClient: client,
-		SequenceID: 0,
-		ID: producerID,
-		Topic: topic,
+		SequenceID:   0,
+		ID:           producerID,
+		Topic:        topic,
+		inflight:     make(chan struct{}, defaultMaxPendingMessages),
 	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if p.MaxPendingMessages > 0 && p.MaxPendingMessages != defaultMaxPendingMessages {
+		p.inflight = make(chan struct{}, p.MaxPendingMessages)
+	}
+
 	return
 }
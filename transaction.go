@@ -0,0 +1,295 @@
+package pulsar
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	pulsar_proto "github.com/t2y/go-pulsar/proto/pb"
+)
+
+// transactionCoordinatorAssignTopic is the well-known topic the broker
+// uses to route transaction coordinator requests to the partition
+// responsible for a given transaction.
+const transactionCoordinatorAssignTopic = "persistent://pulsar/system/transaction_coordinator_assign"
+
+// TxnID identifies a transaction on the broker's transaction log.
+type TxnID struct {
+	MostBits  uint64
+	LeastBits uint64
+}
+
+// Transaction tracks the partitions and subscriptions a client has
+// enlisted in a single broker-side transaction, so each is only
+// registered once before Commit or Abort resolves it.
+type Transaction struct {
+	tc *TransactionCoordinatorClient
+	id TxnID
+
+	mu            sync.Mutex
+	topics        map[string]bool
+	subscriptions map[string]bool
+}
+
+// ID returns the broker-assigned identifier for this transaction.
+func (t *Transaction) ID() TxnID {
+	return t.id
+}
+
+// addPartition registers producer's topic with the transaction the first
+// time it's used, so the coordinator knows to include it when resolving
+// Commit/Abort.
+func (t *Transaction) addPartition(p *Producer) (err error) {
+	t.mu.Lock()
+	already := t.topics[p.Topic]
+	if !already {
+		t.topics[p.Topic] = true
+	}
+	t.mu.Unlock()
+
+	if already {
+		return
+	}
+
+	return t.tc.addPartitionToTxn(t.id, p.Topic)
+}
+
+// addSubscription registers a consumer's subscription with the
+// transaction the first time an ack is staged against it, so Abort knows
+// to trigger redelivery on it.
+func (t *Transaction) addSubscription(c *Consumer) (err error) {
+	key := c.Topic + "/" + c.Subscription
+
+	t.mu.Lock()
+	already := t.subscriptions[key]
+	if !already {
+		t.subscriptions[key] = true
+	}
+	t.mu.Unlock()
+
+	if already {
+		return
+	}
+
+	return t.tc.addSubscriptionToTxn(t.id, c.Topic, c.Subscription)
+}
+
+// Commit makes every send and ack staged under this transaction visible.
+func (t *Transaction) Commit() (err error) {
+	return t.tc.endTxn(t.id, pulsar_proto.TxnAction_COMMIT)
+}
+
+// Abort discards every send staged under this transaction and triggers
+// redelivery of every message acked under it.
+func (t *Transaction) Abort() (err error) {
+	return t.tc.endTxn(t.id, pulsar_proto.TxnAction_ABORT)
+}
+
+// TransactionCoordinatorClient multiplexes NewTxn/AddPartitionToTxn/
+// AddSubscriptionToTxn/EndTxn requests for any number of in-flight
+// Transactions over a single connection to the transaction coordinator.
+type TransactionCoordinatorClient struct {
+	client *PulsarClient
+
+	mu        sync.Mutex
+	requestID uint64
+}
+
+// NewTransactionCoordinatorClient resolves the transaction coordinator's
+// assign topic and returns a client multiplexed over the connection that
+// resolves to, the same way Producer.CreateProducer connects to the broker
+// owning its topic. A plain LookupTopic only asks where the assign topic lives; it
+// doesn't open a connection there, which would leave every txn command
+// multiplexed onto whatever connection client already happened to hold.
+func NewTransactionCoordinatorClient(client *PulsarClient) (tc *TransactionCoordinatorClient, err error) {
+	tc = &TransactionCoordinatorClient{client: client}
+
+	if err = client.SetLookupTopicConnection(transactionCoordinatorAssignTopic, tc.nextRequestID(), false); err != nil {
+		err = errors.Wrap(err, "failed to look up transaction coordinator assign topic")
+		tc = nil
+		return
+	}
+
+	return
+}
+
+func (tc *TransactionCoordinatorClient) nextRequestID() uint64 {
+	return atomic.AddUint64(&tc.requestID, 1) - 1
+}
+
+// NewTransaction starts a new transaction that will be aborted by the
+// coordinator if neither Commit nor Abort is called within timeout.
+func (tc *TransactionCoordinatorClient) NewTransaction(timeout time.Duration) (txn *Transaction, err error) {
+	// mu serializes this Send+Receive round trip against every other TC
+	// command: the connection is shared across all of this client's
+	// in-flight transactions, and nothing correlates a response back to
+	// its request, so two concurrent round trips would steal each
+	// other's replies.
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	requestID := tc.nextRequestID()
+	newTxn := &pulsar_proto.CommandNewTxn{
+		RequestId:     proto.Uint64(requestID),
+		TxnTtlSeconds: proto.Uint64(uint64(timeout / time.Second)),
+	}
+
+	if err = tc.client.Send(&Request{Message: newTxn}); err != nil {
+		err = errors.Wrap(err, "failed to send newTxn command")
+		return
+	}
+	log.Debug("sent newTxn")
+
+	res, err := tc.client.Receive()
+	if err != nil {
+		err = errors.Wrap(err, "failed to receive newTxnResponse command")
+		return
+	}
+
+	response := res.BaseCommand.GetRawCommand().GetNewTxnResponse()
+	if response == nil {
+		err = errors.Errorf("expected newTxnResponse command, got: %v", res.BaseCommand.GetType())
+		return
+	}
+	if response.Error != nil {
+		err = errors.Errorf("failed to create transaction: %v: %s", response.GetError(), response.GetMessage())
+		return
+	}
+
+	txn = &Transaction{
+		tc:            tc,
+		id:            TxnID{MostBits: response.GetTxnidMostBits(), LeastBits: response.GetTxnidLeastBits()},
+		topics:        make(map[string]bool),
+		subscriptions: make(map[string]bool),
+	}
+	return
+}
+
+func (tc *TransactionCoordinatorClient) addPartitionToTxn(id TxnID, topic string) (err error) {
+	// see NewTransaction: serializes this round trip against concurrent
+	// TC commands sharing the same connection.
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	requestID := tc.nextRequestID()
+	add := &pulsar_proto.CommandAddPartitionToTxn{
+		RequestId:      proto.Uint64(requestID),
+		TxnidMostBits:  proto.Uint64(id.MostBits),
+		TxnidLeastBits: proto.Uint64(id.LeastBits),
+		Partitions:     []string{topic},
+	}
+
+	if err = tc.client.Send(&Request{Message: add}); err != nil {
+		err = errors.Wrap(err, "failed to send addPartitionToTxn command")
+		return
+	}
+	log.Debug("sent addPartitionToTxn")
+
+	res, err := tc.client.Receive()
+	if err != nil {
+		err = errors.Wrap(err, "failed to receive addPartitionToTxnResponse command")
+		return
+	}
+
+	response := res.BaseCommand.GetRawCommand().GetAddPartitionToTxnResponse()
+	if response == nil {
+		err = errors.Errorf("expected addPartitionToTxnResponse command, got: %v", res.BaseCommand.GetType())
+		return
+	}
+	if response.Error != nil {
+		err = errors.Errorf("failed to add partition to transaction: %v: %s", response.GetError(), response.GetMessage())
+	}
+	return
+}
+
+func (tc *TransactionCoordinatorClient) addSubscriptionToTxn(id TxnID, topic, subscription string) (err error) {
+	// see NewTransaction: serializes this round trip against concurrent
+	// TC commands sharing the same connection.
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	requestID := tc.nextRequestID()
+	add := &pulsar_proto.CommandAddSubscriptionToTxn{
+		RequestId:      proto.Uint64(requestID),
+		TxnidMostBits:  proto.Uint64(id.MostBits),
+		TxnidLeastBits: proto.Uint64(id.LeastBits),
+		Subscription: []*pulsar_proto.Subscription{
+			{Topic: proto.String(topic), Subscription: proto.String(subscription)},
+		},
+	}
+
+	if err = tc.client.Send(&Request{Message: add}); err != nil {
+		err = errors.Wrap(err, "failed to send addSubscriptionToTxn command")
+		return
+	}
+	log.Debug("sent addSubscriptionToTxn")
+
+	res, err := tc.client.Receive()
+	if err != nil {
+		err = errors.Wrap(err, "failed to receive addSubscriptionToTxnResponse command")
+		return
+	}
+
+	response := res.BaseCommand.GetRawCommand().GetAddSubscriptionToTxnResponse()
+	if response == nil {
+		err = errors.Errorf("expected addSubscriptionToTxnResponse command, got: %v", res.BaseCommand.GetType())
+		return
+	}
+	if response.Error != nil {
+		err = errors.Errorf("failed to add subscription to transaction: %v: %s", response.GetError(), response.GetMessage())
+	}
+	return
+}
+
+func (tc *TransactionCoordinatorClient) endTxn(id TxnID, action pulsar_proto.TxnAction) (err error) {
+	// see NewTransaction: serializes this round trip against concurrent
+	// TC commands sharing the same connection.
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	requestID := tc.nextRequestID()
+	end := &pulsar_proto.CommandEndTxn{
+		RequestId:      proto.Uint64(requestID),
+		TxnidMostBits:  proto.Uint64(id.MostBits),
+		TxnidLeastBits: proto.Uint64(id.LeastBits),
+		TxnAction:      action.Enum(),
+	}
+
+	if err = tc.client.Send(&Request{Message: end}); err != nil {
+		err = errors.Wrap(err, "failed to send endTxn command")
+		return
+	}
+	log.Debug("sent endTxn")
+
+	res, err := tc.client.Receive()
+	if err != nil {
+		err = errors.Wrap(err, "failed to receive endTxnResponse command")
+		return
+	}
+
+	response := res.BaseCommand.GetRawCommand().GetEndTxnResponse()
+	if response == nil {
+		err = errors.Errorf("expected endTxnResponse command, got: %v", res.BaseCommand.GetType())
+		return
+	}
+	if response.Error != nil {
+		err = errors.Errorf("failed to end transaction: %v: %s", response.GetError(), response.GetMessage())
+	}
+	return
+}
+
+// NewTransaction resolves this client's transaction coordinator and
+// starts a new transaction against it.
+func (pc *PulsarClient) NewTransaction(timeout time.Duration) (txn *Transaction, err error) {
+	tc, err := NewTransactionCoordinatorClient(pc)
+	if err != nil {
+		err = errors.Wrap(err, "failed to get transaction coordinator client")
+		return
+	}
+
+	return tc.NewTransaction(timeout)
+}